@@ -0,0 +1,586 @@
+// Package jfr decodes Java Flight Recorder binary recordings (as produced
+// by async-profiler and the JDK's built-in JFR) well enough to extract CPU
+// stack samples from jdk.ExecutionSample / jdk.NativeMethodSample events.
+//
+// JFR chunks are self-describing: a metadata event defines every event and
+// constant-pool type present in the chunk (by name, with a recording-local
+// numeric id and field list), and checkpoint events hold the constant pools
+// (stack traces, methods, classes, symbols) that events reference by id.
+// This package walks both generically using the metadata, rather than
+// hard-coding field offsets, so it keeps working across JDK/profiler
+// versions that add or reorder fields.
+package jfr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	magic = "FLR\x00"
+
+	eventTypeMetadata   = 0
+	eventTypeCheckpoint = 1
+)
+
+// Parse decodes r as a JFR recording and invokes cb once per stack sample
+// found in jdk.ExecutionSample / jdk.NativeMethodSample events, with a
+// "Class.method;Class.method;..." stack key (root first, sample leaf last)
+// and a weight of 1 per occurrence.
+func Parse(r io.Reader, cb func(stack []byte, count int)) error {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("jfr: reading input: %w", err)
+	}
+
+	p := &parser{br: bytes.NewReader(buf), classesByName: map[string]int64{}, classesByID: map[int64]*classDef{}, pools: map[int64]map[int64]map[string]interface{}{}}
+	for p.br.Len() > 0 {
+		if err := p.parseChunk(cb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fieldDef struct {
+	name         string
+	typeID       int64
+	constantPool bool
+	array        bool
+}
+
+type classDef struct {
+	name   string
+	fields []fieldDef
+}
+
+type parser struct {
+	br            *bytes.Reader
+	classesByName map[string]int64
+	classesByID   map[int64]*classDef
+	pools         map[int64]map[int64]map[string]interface{}
+}
+
+func (p *parser) parseChunk(cb func([]byte, int)) error {
+	var magicBuf [4]byte
+	if _, err := io.ReadFull(p.br, magicBuf[:]); err != nil {
+		return fmt.Errorf("jfr: reading magic: %w", err)
+	}
+	if string(magicBuf[:]) != magic {
+		return fmt.Errorf("jfr: bad chunk magic %q", magicBuf)
+	}
+
+	var header struct {
+		Major, Minor               int16
+		Size                       int64
+		ConstantPoolOffset         int64
+		MetadataOffset             int64
+		StartNanos, DurationNanos  int64
+		StartTicks, TicksPerSecond int64
+		Features                   int32
+	}
+	for _, v := range []interface{}{&header.Major, &header.Minor, &header.Size, &header.ConstantPoolOffset,
+		&header.MetadataOffset, &header.StartNanos, &header.DurationNanos, &header.StartTicks,
+		&header.TicksPerSecond, &header.Features} {
+		if err := binary.Read(p.br, binary.BigEndian, v); err != nil {
+			return fmt.Errorf("jfr: reading chunk header: %w", err)
+		}
+	}
+
+	chunkBody := make([]byte, header.Size-68)
+	if _, err := io.ReadFull(p.br, chunkBody); err != nil {
+		return fmt.Errorf("jfr: reading chunk body: %w", err)
+	}
+	body := bytes.NewReader(chunkBody)
+
+	// Metadata and constant pools are addressed relative to the start of
+	// the chunk (where the magic begins), while we've already consumed the
+	// 68 byte header; rebase offsets accordingly.
+	if err := p.parseMetadataAt(body, header.MetadataOffset-68); err != nil {
+		return err
+	}
+	if err := p.parseCheckpointChainAt(body, header.ConstantPoolOffset-68); err != nil {
+		return err
+	}
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return p.parseSampleEvents(body, cb)
+}
+
+// eventHeader is the size+type prefix common to every JFR event.
+type eventHeader struct {
+	start  int64
+	size   uint64
+	typeID int64
+}
+
+func readEventHeader(body *bytes.Reader) (eventHeader, error) {
+	start := body.Size() - int64(body.Len())
+	size, err := readVarint(body)
+	if err != nil {
+		return eventHeader{}, err
+	}
+	typeID, err := readVarint(body)
+	if err != nil {
+		return eventHeader{}, err
+	}
+	return eventHeader{start: start, size: size, typeID: int64(typeID)}, nil
+}
+
+// parseMetadataAt reads the chunk's single metadata event at offset. It
+// describes the name and field layout of every event and constant-pool
+// type used by the rest of the chunk.
+func (p *parser) parseMetadataAt(body *bytes.Reader, offset int64) error {
+	if offset < 0 || offset >= body.Size() {
+		return nil
+	}
+	if _, err := body.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	h, err := readEventHeader(body)
+	if err != nil || h.typeID != eventTypeMetadata {
+		return nil
+	}
+	return p.parseMetadataEvent(body)
+}
+
+// parseCheckpointChainAt parses every checkpoint ("constant pool") event
+// in the chunk, starting at offset (the last checkpoint, per the chunk
+// header) and following each event's delta-to-next field back to the
+// previous checkpoint until it reaches 0. A chunk can flush its constant
+// pools more than once, and a stack trace/method/class/symbol a sample
+// references may live in any of those flushes, so all of them have to be
+// visited, not just the last.
+func (p *parser) parseCheckpointChainAt(body *bytes.Reader, offset int64) error {
+	visited := map[int64]bool{}
+	for offset >= 0 && offset < body.Size() && !visited[offset] {
+		visited[offset] = true
+		if _, err := body.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		h, err := readEventHeader(body)
+		if err != nil || h.typeID != eventTypeCheckpoint {
+			return nil
+		}
+		delta, err := p.parseCheckpointEvent(body)
+		if err != nil {
+			return err
+		}
+		if delta == 0 {
+			return nil
+		}
+		offset = h.start - delta
+	}
+	return nil
+}
+
+// parseSampleEvents walks every event in the chunk looking for
+// jdk.ExecutionSample / jdk.NativeMethodSample events, resolving each
+// against the pools already populated by parseMetadataAt and
+// parseCheckpointChainAt.
+func (p *parser) parseSampleEvents(body *bytes.Reader, cb func([]byte, int)) error {
+	for body.Len() > 0 {
+		h, err := readEventHeader(body)
+		if err != nil {
+			return nil
+		}
+		payloadEnd := h.start + int64(h.size)
+
+		if class := p.classesByID[h.typeID]; class != nil && isSampleEvent(class.name) {
+			p.parseSampleEvent(body, class, cb)
+		}
+
+		if _, err := body.Seek(payloadEnd, io.SeekStart); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+func isSampleEvent(name string) bool {
+	return name == "jdk.ExecutionSample" || name == "jdk.NativeMethodSample"
+}
+
+func (p *parser) parseMetadataEvent(r *bytes.Reader) error {
+	if _, err := readVarint(r); err != nil { // metadata id
+		return err
+	}
+	if _, err := readVarint(r); err != nil { // startTime
+		return err
+	}
+	if _, err := readVarint(r); err != nil { // duration
+		return err
+	}
+	strCount, err := readVarint(r)
+	if err != nil {
+		return err
+	}
+	strs := make([]string, strCount)
+	for i := range strs {
+		if strs[i], err = readString(r); err != nil {
+			return err
+		}
+	}
+	root, err := readElement(r, strs)
+	if err != nil {
+		return err
+	}
+	p.registerClasses(root)
+	return nil
+}
+
+func (p *parser) registerClasses(e *element) {
+	if e.name == "class" {
+		id := parseID(e.attrs["id"])
+		name := e.attrs["name"]
+		class := &classDef{name: name}
+		for _, f := range e.children {
+			if f.name != "field" {
+				continue
+			}
+			class.fields = append(class.fields, fieldDef{
+				name:         f.attrs["name"],
+				typeID:       parseID(f.attrs["class"]),
+				constantPool: f.attrs["constantPool"] == "true",
+				array:        f.attrs["array"] == "true" || f.attrs["dimension"] == "1",
+			})
+		}
+		p.classesByID[id] = class
+		p.classesByName[name] = id
+	}
+	for _, c := range e.children {
+		p.registerClasses(c)
+	}
+}
+
+// parseCheckpointEvent decodes one checkpoint event's constant pools and
+// returns the distance, in bytes, back to the previous checkpoint event
+// in the chunk, or 0 if there isn't one.
+func (p *parser) parseCheckpointEvent(r *bytes.Reader) (int64, error) {
+	if _, err := readVarint(r); err != nil { // startTime
+		return 0, err
+	}
+	if _, err := readVarint(r); err != nil { // duration
+		return 0, err
+	}
+	delta, err := readVarint(r) // delta-to-next (previous checkpoint)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.ReadByte(); err != nil { // flush flag
+		return 0, err
+	}
+
+	poolCount, err := readVarint(r)
+	if err != nil {
+		return 0, err
+	}
+	for i := uint64(0); i < poolCount; i++ {
+		classID, err := readVarint(r)
+		if err != nil {
+			return 0, err
+		}
+		entryCount, err := readVarint(r)
+		if err != nil {
+			return 0, err
+		}
+		pool := p.pools[int64(classID)]
+		if pool == nil {
+			pool = map[int64]map[string]interface{}{}
+			p.pools[int64(classID)] = pool
+		}
+		for j := uint64(0); j < entryCount; j++ {
+			constantID, err := readVarint(r)
+			if err != nil {
+				return 0, err
+			}
+			v, err := p.readValue(r, int64(classID))
+			if err != nil {
+				return 0, err
+			}
+			if fields, ok := v.(map[string]interface{}); ok {
+				pool[int64(constantID)] = fields
+			}
+		}
+	}
+	return int64(delta), nil
+}
+
+func (p *parser) parseSampleEvent(r *bytes.Reader, class *classDef, cb func([]byte, int)) {
+	v, err := p.readValue(r, -1, class)
+	if err != nil {
+		return
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	stackTraceID, ok := fields["stackTrace"].(int64)
+	if !ok {
+		return
+	}
+	stack := p.resolveStack(stackTraceID)
+	if len(stack) == 0 {
+		return
+	}
+	cb([]byte(strings.Join(stack, ";")), 1)
+}
+
+func (p *parser) resolveStack(stackTraceID int64) []string {
+	stClassID, ok := p.classesByName["jdk.types.StackTrace"]
+	if !ok {
+		return nil
+	}
+	st := p.pools[stClassID][stackTraceID]
+	if st == nil {
+		return nil
+	}
+	framesRaw, _ := st["frames"].([]interface{})
+
+	frames := make([]string, 0, len(framesRaw))
+	for i := len(framesRaw) - 1; i >= 0; i-- {
+		frame, ok := framesRaw[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name := p.resolveFrameName(frame); name != "" {
+			frames = append(frames, name)
+		}
+	}
+	return frames
+}
+
+func (p *parser) resolveFrameName(frame map[string]interface{}) string {
+	methodID, ok := frame["method"].(int64)
+	if !ok {
+		return ""
+	}
+	methodClassID, ok := p.classesByName["jdk.types.Method"]
+	if !ok {
+		return ""
+	}
+	method := p.pools[methodClassID][methodID]
+	if method == nil {
+		return ""
+	}
+
+	className := p.resolveClassName(method["type"])
+	methodName := p.resolveSymbol(method["name"])
+	if className == "" && methodName == "" {
+		return ""
+	}
+	if className == "" {
+		return methodName
+	}
+	return className + "." + methodName
+}
+
+func (p *parser) resolveClassName(classRef interface{}) string {
+	classID, ok := classRef.(int64)
+	if !ok {
+		return ""
+	}
+	classClassID, ok := p.classesByName["jdk.types.Class"]
+	if !ok {
+		return ""
+	}
+	class := p.pools[classClassID][classID]
+	if class == nil {
+		return ""
+	}
+	return p.resolveSymbol(class["name"])
+}
+
+func (p *parser) resolveSymbol(symbolRef interface{}) string {
+	symbolID, ok := symbolRef.(int64)
+	if !ok {
+		return ""
+	}
+	symbolClassID, ok := p.classesByName["jdk.types.Symbol"]
+	if !ok {
+		return ""
+	}
+	symbol := p.pools[symbolClassID][symbolID]
+	if symbol == nil {
+		return ""
+	}
+	s, _ := symbol["string"].(string)
+	return strings.ReplaceAll(s, "/", ".")
+}
+
+// readValue decodes one instance of classID's fields, using cls directly
+// when provided (for event types that aren't registered in classesByID
+// under a stable key at call time).
+func (p *parser) readValue(r *bytes.Reader, classID int64, cls ...*classDef) (interface{}, error) {
+	class := p.classesByID[classID]
+	if len(cls) > 0 {
+		class = cls[0]
+	}
+	if class == nil {
+		return nil, fmt.Errorf("jfr: unknown class id %d", classID)
+	}
+
+	if len(class.fields) == 0 {
+		return p.readPrimitive(r, class.name)
+	}
+
+	values := make(map[string]interface{}, len(class.fields))
+	for _, f := range class.fields {
+		if f.array {
+			count, err := readVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			arr := make([]interface{}, count)
+			for i := range arr {
+				if arr[i], err = p.readFieldValue(r, f); err != nil {
+					return nil, err
+				}
+			}
+			values[f.name] = arr
+			continue
+		}
+		v, err := p.readFieldValue(r, f)
+		if err != nil {
+			return nil, err
+		}
+		values[f.name] = v
+	}
+	return values, nil
+}
+
+func (p *parser) readFieldValue(r *bytes.Reader, f fieldDef) (interface{}, error) {
+	if f.constantPool {
+		id, err := readVarint(r)
+		return int64(id), err
+	}
+	return p.readValue(r, f.typeID)
+}
+
+func (p *parser) readPrimitive(r *bytes.Reader, typeName string) (interface{}, error) {
+	switch typeName {
+	case "java.lang.String":
+		return readString(r)
+	case "boolean":
+		b, err := r.ReadByte()
+		return b != 0, err
+	case "float":
+		var v uint32
+		err := binary.Read(r, binary.BigEndian, &v)
+		return v, err
+	case "double":
+		var v uint64
+		err := binary.Read(r, binary.BigEndian, &v)
+		return v, err
+	default:
+		v, err := readVarint(r)
+		return int64(v), err
+	}
+}
+
+// element is a generic node of the metadata event's self-describing tree.
+type element struct {
+	name     string
+	attrs    map[string]string
+	children []*element
+}
+
+func readElement(r *bytes.Reader, strs []string) (*element, error) {
+	nameIdx, err := readVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	e := &element{name: strAt(strs, nameIdx), attrs: map[string]string{}}
+
+	attrCount, err := readVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < attrCount; i++ {
+		kIdx, err := readVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		vIdx, err := readVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		e.attrs[strAt(strs, kIdx)] = strAt(strs, vIdx)
+	}
+
+	childCount, err := readVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	e.children = make([]*element, childCount)
+	for i := range e.children {
+		if e.children[i], err = readElement(r, strs); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func strAt(strs []string, i uint64) string {
+	if int(i) < len(strs) {
+		return strs[i]
+	}
+	return ""
+}
+
+func parseID(s string) int64 {
+	var v int64
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return v
+		}
+		v = v*10 + int64(c-'0')
+	}
+	return v
+}
+
+// readVarint reads a JFR "compressed" unsigned LEB128 integer.
+func readVarint(r *bytes.Reader) (uint64, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return v, nil
+}
+
+// readString reads a JFR encoded string: a leading encoding byte (0 = null,
+// 1 = empty, 3 = UTF-8 with a varint length prefix) followed by the bytes.
+func readString(r *bytes.Reader) (string, error) {
+	enc, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	switch enc {
+	case 0, 1:
+		return "", nil
+	case 3:
+		n, err := readVarint(r)
+		if err != nil {
+			return "", err
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	default:
+		return "", fmt.Errorf("jfr: unsupported string encoding %d", enc)
+	}
+}
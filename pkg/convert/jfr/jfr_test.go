@@ -0,0 +1,337 @@
+package jfr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func encodeVarint(v uint64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			out = append(out, b|0x80)
+			continue
+		}
+		out = append(out, b)
+		return out
+	}
+}
+
+func encodeString(s string) []byte {
+	if s == "" {
+		return []byte{1}
+	}
+	out := []byte{3}
+	out = append(out, encodeVarint(uint64(len(s)))...)
+	return append(out, s...)
+}
+
+func TestReadVarint(t *testing.T) {
+	cases := []uint64{0, 1, 127, 128, 300, 1 << 20, 1 << 40}
+	for _, want := range cases {
+		r := bytes.NewReader(encodeVarint(want))
+		got, err := readVarint(r)
+		if err != nil {
+			t.Fatalf("readVarint(%d): %v", want, err)
+		}
+		if got != want {
+			t.Errorf("readVarint roundtrip: want %d, got %d", want, got)
+		}
+	}
+}
+
+func TestReadString(t *testing.T) {
+	cases := []string{"", "hello", "jdk.types.StackTrace"}
+	for _, want := range cases {
+		r := bytes.NewReader(encodeString(want))
+		got, err := readString(r)
+		if err != nil {
+			t.Fatalf("readString(%q): %v", want, err)
+		}
+		if got != want {
+			t.Errorf("readString roundtrip: want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestParseID(t *testing.T) {
+	cases := map[string]int64{"0": 0, "1": 1, "42": 42, "1234": 1234}
+	for in, want := range cases {
+		if got := parseID(in); got != want {
+			t.Errorf("parseID(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+// --- metadata element tree builder ---
+
+type fieldSpec struct {
+	name         string
+	class        int64
+	constantPool bool
+	array        bool
+}
+
+type classSpec struct {
+	id     int64
+	name   string
+	fields []fieldSpec
+}
+
+// stringPool interns strings and returns their index, matching the
+// metadata event's flat string constant pool.
+type stringPool struct {
+	values []string
+	index  map[string]uint64
+}
+
+func newStringPool() *stringPool { return &stringPool{index: map[string]uint64{}} }
+
+func (p *stringPool) intern(s string) uint64 {
+	if i, ok := p.index[s]; ok {
+		return i
+	}
+	i := uint64(len(p.values))
+	p.values = append(p.values, s)
+	p.index[s] = i
+	return i
+}
+
+// buildElement encodes one metadata tree node: nameIdx, attrs, children.
+func buildElement(sp *stringPool, name string, attrs map[string]string, children [][]byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(encodeVarint(sp.intern(name)))
+	buf.Write(encodeVarint(uint64(len(attrs))))
+	for k, v := range attrs {
+		buf.Write(encodeVarint(sp.intern(k)))
+		buf.Write(encodeVarint(sp.intern(v)))
+	}
+	buf.Write(encodeVarint(uint64(len(children))))
+	for _, c := range children {
+		buf.Write(c)
+	}
+	return buf.Bytes()
+}
+
+func buildClassElement(sp *stringPool, c classSpec) []byte {
+	fieldElems := make([][]byte, len(c.fields))
+	for i, f := range c.fields {
+		attrs := map[string]string{"name": f.name, "class": itoa(f.class)}
+		if f.constantPool {
+			attrs["constantPool"] = "true"
+		}
+		if f.array {
+			attrs["array"] = "true"
+		}
+		fieldElems[i] = buildElement(sp, "field", attrs, nil)
+	}
+	attrs := map[string]string{"id": itoa(c.id), "name": c.name}
+	return buildElement(sp, "class", attrs, fieldElems)
+}
+
+func itoa(v int64) string {
+	if v == 0 {
+		return "0"
+	}
+	neg := v < 0
+	if neg {
+		v = -v
+	}
+	var digits []byte
+	for v > 0 {
+		digits = append([]byte{byte('0' + v%10)}, digits...)
+		v /= 10
+	}
+	if neg {
+		digits = append([]byte{'-'}, digits...)
+	}
+	return string(digits)
+}
+
+// buildMetadataPayload builds a full jdk metadata event payload (minus
+// the size+typeID event header) out of classSpecs.
+func buildMetadataPayload(classes []classSpec) []byte {
+	sp := newStringPool()
+	classElems := make([][]byte, len(classes))
+	for i, c := range classes {
+		classElems[i] = buildClassElement(sp, c)
+	}
+	root := buildElement(sp, "root", nil, classElems)
+
+	buf := new(bytes.Buffer)
+	buf.Write(encodeVarint(0)) // metadata id
+	buf.Write(encodeVarint(0)) // startTime
+	buf.Write(encodeVarint(0)) // duration
+	buf.Write(encodeVarint(uint64(len(sp.values))))
+	for _, s := range sp.values {
+		buf.Write(encodeString(s))
+	}
+	buf.Write(root)
+	return buf.Bytes()
+}
+
+// buildCheckpointPayload builds a checkpoint event payload out of raw,
+// already-encoded pool entry values, keyed by classID then constantID.
+func buildCheckpointPayload(delta int64, pools map[int64]map[int64][]byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(encodeVarint(0))             // startTime
+	buf.Write(encodeVarint(0))             // duration
+	buf.Write(encodeVarint(uint64(delta))) // delta-to-next (previous checkpoint)
+	buf.WriteByte(0)                       // flush flag
+	buf.Write(encodeVarint(uint64(len(pools))))
+	for classID, entries := range pools {
+		buf.Write(encodeVarint(uint64(classID)))
+		buf.Write(encodeVarint(uint64(len(entries))))
+		for constantID, value := range entries {
+			buf.Write(encodeVarint(uint64(constantID)))
+			buf.Write(value)
+		}
+	}
+	return buf.Bytes()
+}
+
+// buildEvent wraps payload with a JFR event's self-describing size+typeID
+// prefix. size covers the whole event including itself, so its own
+// varint length is solved for by fixed point.
+func buildEvent(typeID int64, payload []byte) []byte {
+	typeIDBytes := encodeVarint(uint64(typeID))
+	base := len(typeIDBytes) + len(payload)
+	n := len(encodeVarint(uint64(base)))
+	for {
+		total := base + n
+		sizeBytes := encodeVarint(uint64(total))
+		if len(sizeBytes) == n {
+			out := make([]byte, 0, total)
+			out = append(out, sizeBytes...)
+			out = append(out, typeIDBytes...)
+			out = append(out, payload...)
+			return out
+		}
+		n = len(sizeBytes)
+	}
+}
+
+// TestParseMultipleCheckpoints builds a minimal synthetic JFR recording
+// whose constant pools are split across two checkpoint events chained via
+// the delta-to-next field, with the chunk header pointing only at the
+// last one. It exercises parseCheckpointChainAt's backward traversal:
+// resolving the sample's stack requires entries from both checkpoints.
+func TestParseMultipleCheckpoints(t *testing.T) {
+	// IDs start at 101 so they can't collide with the reserved
+	// eventTypeMetadata/eventTypeCheckpoint event type ids (0/1).
+	const (
+		classSymbol = 101
+		classString = 102
+		classClass  = 103
+		classMethod = 104
+		classFrame  = 105
+		classTrace  = 106
+		classSample = 107
+	)
+
+	metadataPayload := buildMetadataPayload([]classSpec{
+		{id: classSymbol, name: "jdk.types.Symbol", fields: []fieldSpec{
+			{name: "string", class: classString},
+		}},
+		{id: classString, name: "java.lang.String"},
+		{id: classClass, name: "jdk.types.Class", fields: []fieldSpec{
+			{name: "name", class: classSymbol, constantPool: true},
+		}},
+		{id: classMethod, name: "jdk.types.Method", fields: []fieldSpec{
+			{name: "type", class: classClass, constantPool: true},
+			{name: "name", class: classSymbol, constantPool: true},
+		}},
+		{id: classFrame, name: "jdk.types.StackFrame", fields: []fieldSpec{
+			{name: "method", class: classMethod, constantPool: true},
+		}},
+		{id: classTrace, name: "jdk.types.StackTrace", fields: []fieldSpec{
+			{name: "frames", class: classFrame, array: true},
+		}},
+		{id: classSample, name: "jdk.ExecutionSample", fields: []fieldSpec{
+			{name: "stackTrace", class: classTrace, constantPool: true},
+		}},
+	})
+	metadataEvent := buildEvent(eventTypeMetadata, metadataPayload)
+
+	// Checkpoint A (earlier): only the Symbol pool, first in the chain.
+	checkpointAPayload := buildCheckpointPayload(0, map[int64]map[int64][]byte{
+		classSymbol: {
+			10: encodeString("Foo"),
+			11: encodeString("bar"),
+		},
+	})
+	checkpointAEvent := buildEvent(eventTypeCheckpoint, checkpointAPayload)
+
+	// Checkpoint B (last, referenced by the chunk header): Class, Method
+	// and StackTrace pools, referencing the Symbol entries from A.
+	stackTraceValue := append(encodeVarint(1), encodeVarint(30)...) // 1 frame, method=30
+	checkpointBPayload := buildCheckpointPayload(int64(len(checkpointAEvent)), map[int64]map[int64][]byte{
+		classClass: {
+			20: encodeVarint(10), // name -> Symbol 10 ("Foo")
+		},
+		classMethod: {
+			30: append(encodeVarint(20), encodeVarint(11)...), // type=20, name=11 ("bar")
+		},
+		classTrace: {
+			40: stackTraceValue,
+		},
+	})
+	checkpointBEvent := buildEvent(eventTypeCheckpoint, checkpointBPayload)
+
+	sampleEvent := buildEvent(classSample, encodeVarint(40)) // stackTrace -> 40
+
+	body := new(bytes.Buffer)
+	metadataOffset := body.Len()
+	body.Write(metadataEvent)
+	body.Write(checkpointAEvent) // earlier checkpoint; only reachable via B's delta
+	checkpointBOffset := body.Len()
+	body.Write(checkpointBEvent)
+	body.Write(sampleEvent)
+
+	chunk := new(bytes.Buffer)
+	chunk.WriteString(magic)
+	header := struct {
+		Major, Minor               int16
+		Size                       int64
+		ConstantPoolOffset         int64
+		MetadataOffset             int64
+		StartNanos, DurationNanos  int64
+		StartTicks, TicksPerSecond int64
+		Features                   int32
+	}{
+		Major: 2, Minor: 0,
+		Size:               int64(68 + body.Len()),
+		ConstantPoolOffset: int64(68 + checkpointBOffset),
+		MetadataOffset:     int64(68 + metadataOffset),
+	}
+	for _, v := range []interface{}{&header.Major, &header.Minor, &header.Size, &header.ConstantPoolOffset,
+		&header.MetadataOffset, &header.StartNanos, &header.DurationNanos, &header.StartTicks,
+		&header.TicksPerSecond, &header.Features} {
+		if err := binary.Write(chunk, binary.BigEndian, v); err != nil {
+			t.Fatalf("writing header: %v", err)
+		}
+	}
+	chunk.Write(body.Bytes())
+
+	var gotStacks []string
+	var gotCounts []int
+	err := Parse(bytes.NewReader(chunk.Bytes()), func(stack []byte, count int) {
+		gotStacks = append(gotStacks, string(stack))
+		gotCounts = append(gotCounts, count)
+	})
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(gotStacks) != 1 {
+		t.Fatalf("expected 1 sample, got %d: %v", len(gotStacks), gotStacks)
+	}
+	if want := "Foo.bar"; gotStacks[0] != want {
+		t.Errorf("stack = %q, want %q (checkpoint chain wasn't fully resolved)", gotStacks[0], want)
+	}
+	if gotCounts[0] != 1 {
+		t.Errorf("count = %d, want 1", gotCounts[0])
+	}
+}
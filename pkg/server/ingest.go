@@ -11,6 +11,7 @@ import (
 
 	"github.com/pyroscope-io/pyroscope/pkg/agent/types"
 	"github.com/pyroscope-io/pyroscope/pkg/convert"
+	"github.com/pyroscope-io/pyroscope/pkg/convert/jfr"
 	"github.com/pyroscope-io/pyroscope/pkg/storage"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
@@ -18,6 +19,7 @@ import (
 )
 
 type ingestParams struct {
+	format          string
 	parserFunc      parserFunc
 	storageKey      *segment.Key
 	spyName         string
@@ -64,9 +66,56 @@ func (ctrl *Controller) ingestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	body, err := decompressBody(r)
+	if err != nil {
+		ctrl.writeInvalidParameterError(w, err)
+		return
+	}
+	defer body.Close()
+	r.Body = body
+
+	tenantID, err := ctrl.authenticateTenant(r)
+	if err != nil {
+		ctrl.writeError(w, http.StatusUnauthorized, err, "error happened while authenticating tenant")
+		return
+	}
+
+	if ip.format == formatNDJSONBatch {
+		ctrl.ingestBatch(w, r, tenantID)
+		return
+	}
+
+	if tenantID != "" {
+		ip.storageKey.Labels()["tenant"] = tenantID
+		if err := ctrl.enforceTenantLimits(tenantID, fmt.Sprintf("%v", ip.storageKey.Labels())); err != nil {
+			ctrl.writeError(w, http.StatusTooManyRequests, err, "tenant limit exceeded")
+			return
+		}
+		ctrl.statsInc("ingest:tenant:" + tenantID)
+	}
+
+	if rl := ctrl.currentRelabeler(); rl != nil {
+		keep, err := rl.Apply(ip.storageKey.Labels())
+		if err != nil {
+			ctrl.writeInvalidParameterError(w, fmt.Errorf("relabel: %w", err))
+			return
+		}
+		if !keep {
+			ctrl.statsInc("ingest:dropped")
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte("dropped=1"))
+			return
+		}
+	}
+
+	if ip.format == formatPprof {
+		ctrl.ingestPprof(w, r, &ip)
+		return
+	}
+
 	var t *tree.Tree
 	tmpBuf := ctrl.bufferPool.Get()
-	t, err := ip.parserFunc(r.Body, tmpBuf.B)
+	t, err = ip.parserFunc(r.Body, tmpBuf.B)
 	ctrl.bufferPool.Put(tmpBuf)
 
 	if err != nil {
@@ -106,6 +155,17 @@ func (ctrl *Controller) ingestParamsFromRequest(r *http.Request, ip *ingestParam
 		ip.parserFunc = wrapConvertFunctionBuf(convert.ParseTrieBuf)
 	case format == "lines":
 		ip.parserFunc = wrapConvertFunction(convert.ParseIndividualLines)
+	case format == formatPprof, contentType == "application/octet-stream+pprof":
+		// Parsing happens in ingestPprof, which produces one tree per pprof
+		// sample type rather than the single tree the other formats yield.
+		ip.format = formatPprof
+	case format == "jfr", contentType == "application/octet-stream+jfr":
+		ip.format = "jfr"
+		ip.parserFunc = wrapConvertFunction(jfr.Parse)
+	case format == formatNDJSONBatch:
+		// Each line of the request body carries its own format/name/etc,
+		// so ingestBatch takes over entirely instead of using ip.parserFunc.
+		ip.format = formatNDJSONBatch
 	default:
 		ip.parserFunc = wrapConvertFunction(convert.ParseGroups)
 	}
@@ -153,6 +213,12 @@ func (ctrl *Controller) ingestParamsFromRequest(r *http.Request, ip *ingestParam
 		ip.aggregationType = "sum"
 	}
 
+	if ip.format == formatNDJSONBatch {
+		// Each ndjson-batch record carries its own name; there's no single
+		// top-level storage key to parse.
+		return nil
+	}
+
 	var err error
 	ip.storageKey, err = segment.ParseKey(q.Get("name"))
 	if err != nil {
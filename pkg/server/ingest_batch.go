@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/agent/types"
+	"github.com/pyroscope-io/pyroscope/pkg/convert"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+	"github.com/pyroscope-io/pyroscope/pkg/util/attime"
+
+	"github.com/google/pprof/profile"
+)
+
+// formatNDJSONBatch is the format identifier for a request body made up
+// of many newline-delimited JSON envelopes, each carrying one profile.
+const formatNDJSONBatch = "ndjson-batch"
+
+// maxBatchLineSize bounds how large a single ndjson-batch line (and so a
+// single base64-encoded profile) is allowed to be.
+const maxBatchLineSize = 64 << 20
+
+// batchEnvelope is one line of an ndjson-batch request body.
+type batchEnvelope struct {
+	Name            string `json:"name"`
+	From            string `json:"from"`
+	Until           string `json:"until"`
+	SampleRate      uint32 `json:"sampleRate"`
+	SpyName         string `json:"spyName"`
+	Units           string `json:"units"`
+	AggregationType string `json:"aggregationType"`
+	Format          string `json:"format"`
+	Payload         string `json:"payload"` // base64-encoded profile body
+}
+
+// batchRecordStatus reports the outcome of ingesting a single
+// batchEnvelope, returned in request order.
+type batchRecordStatus struct {
+	Name  string `json:"name,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ingestBatch handles format=ndjson-batch: it stream-decodes the request
+// body one line at a time, ingesting each envelope independently so that
+// many short profiles can be pushed in a single HTTP request.
+func (ctrl *Controller) ingestBatch(w http.ResponseWriter, r *http.Request, tenantID string) {
+	// r.Body's lifecycle (including returning any pooled decoder from
+	// decompressBody) is owned by ingestHandler's defer; don't close it here.
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchLineSize)
+
+	var statuses []batchRecordStatus
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		statuses = append(statuses, ctrl.ingestBatchRecord(line, tenantID))
+	}
+	if err := scanner.Err(); err != nil {
+		ctrl.writeError(w, http.StatusUnprocessableEntity, err, "error happened while reading ndjson batch")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(statuses)
+}
+
+func (ctrl *Controller) ingestBatchRecord(line []byte, tenantID string) batchRecordStatus {
+	var env batchEnvelope
+	if err := json.Unmarshal(line, &env); err != nil {
+		return batchRecordStatus{Error: fmt.Sprintf("invalid envelope: %v", err)}
+	}
+
+	status := batchRecordStatus{Name: env.Name}
+	storageKey, err := segment.ParseKey(env.Name)
+	if err != nil {
+		status.Error = fmt.Sprintf("name: %v", err)
+		return status
+	}
+
+	if tenantID != "" {
+		storageKey.Labels()["tenant"] = tenantID
+		if err := ctrl.enforceTenantLimits(tenantID, fmt.Sprintf("%v", storageKey.Labels())); err != nil {
+			status.Error = err.Error()
+			return status
+		}
+		ctrl.statsInc("ingest:tenant:" + tenantID)
+	}
+
+	if rl := ctrl.currentRelabeler(); rl != nil {
+		keep, err := rl.Apply(storageKey.Labels())
+		if err != nil {
+			status.Error = fmt.Sprintf("relabel: %v", err)
+			return status
+		}
+		if !keep {
+			ctrl.statsInc("ingest:dropped")
+			status.Error = "dropped"
+			return status
+		}
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		status.Error = fmt.Sprintf("payload: %v", err)
+		return status
+	}
+
+	from, until := time.Now(), time.Now()
+	if env.From != "" {
+		from = attime.Parse(env.From)
+	}
+	if env.Until != "" {
+		until = attime.Parse(env.Until)
+	}
+	sampleRate := env.SampleRate
+	if sampleRate == 0 {
+		sampleRate = types.DefaultSampleRate
+	}
+	spyName := env.SpyName
+	if spyName == "" {
+		spyName = "unknown"
+	}
+	units := env.Units
+	if units == "" {
+		units = "samples"
+	}
+	aggregationType := env.AggregationType
+	if aggregationType == "" {
+		aggregationType = "sum"
+	}
+
+	if env.Format == formatPprof {
+		if err := ctrl.ingestBatchPprof(payload, storageKey, from, until, spyName, sampleRate); err != nil {
+			status.Error = err.Error()
+		}
+		return status
+	}
+
+	parse, err := parserFuncForFormat(env.Format)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	tmpBuf := ctrl.bufferPool.Get()
+	t, err := parse(bytes.NewReader(payload), tmpBuf.B)
+	ctrl.bufferPool.Put(tmpBuf)
+	if err != nil {
+		status.Error = fmt.Sprintf("error happened while parsing record body: %v", err)
+		return status
+	}
+
+	err = ctrl.ingester.Put(&storage.PutInput{
+		StartTime:       from,
+		EndTime:         until,
+		Key:             storageKey,
+		Val:             t,
+		SpyName:         spyName,
+		SampleRate:      sampleRate,
+		Units:           units,
+		AggregationType: aggregationType,
+	})
+	if err != nil {
+		status.Error = fmt.Sprintf("error happened while ingesting data: %v", err)
+		return status
+	}
+
+	ctrl.statsInc("ingest")
+	ctrl.statsInc("ingest:" + spyName)
+	k := *storageKey
+	ctrl.appStats.Add(hashString(k.AppName()))
+	return status
+}
+
+// ingestBatchPprof ingests a single gzipped pprof record, one tree per
+// sample type, mirroring ingestPprof for the batch code path.
+func (ctrl *Controller) ingestBatchPprof(payload []byte, storageKey *segment.Key, from, until time.Time, spyName string, sampleRate uint32) error {
+	gzr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("pprof: %w", err)
+	}
+	defer gzr.Close()
+
+	p, err := profile.Parse(gzr)
+	if err != nil {
+		return fmt.Errorf("error happened while parsing pprof profile: %w", err)
+	}
+
+	for i, st := range p.SampleType {
+		t := pprofSampleTypeTree(p, i)
+		if t == nil {
+			continue
+		}
+		cfg, ok := pprofSampleTypeConfigs[st.Type]
+		if !ok {
+			cfg = pprofSampleTypeConfig{units: "samples", aggregationType: "sum"}
+		}
+		err = ctrl.ingester.Put(&storage.PutInput{
+			StartTime:       from,
+			EndTime:         until,
+			Key:             pprofKeyForSampleType(storageKey, st.Type),
+			Val:             t,
+			SpyName:         spyName,
+			SampleRate:      sampleRate,
+			Units:           cfg.units,
+			AggregationType: cfg.aggregationType,
+		})
+		if err != nil {
+			return fmt.Errorf("error happened while ingesting data: %w", err)
+		}
+		ctrl.statsInc("ingest")
+		ctrl.statsInc("ingest:" + spyName)
+	}
+	k := *storageKey
+	ctrl.appStats.Add(hashString(k.AppName()))
+	return nil
+}
+
+// parserFuncForFormat resolves the parserFunc for an ndjson-batch record's
+// inner format: groups (also the empty format), tree, trie or lines. pprof
+// records are handled by ingestBatchPprof before this is called; any other
+// format, jfr included, is an error rather than falling back to groups.
+func parserFuncForFormat(format string) (parserFunc, error) {
+	switch format {
+	case "", "group", "groups":
+		return wrapConvertFunction(convert.ParseGroups), nil
+	case "tree":
+		return wrapConvertFunctionReader(tree.DeserializeV1NoDict), nil
+	case "trie":
+		return wrapConvertFunctionBuf(convert.ParseTrieBuf), nil
+	case "lines":
+		return wrapConvertFunction(convert.ParseIndividualLines), nil
+	default:
+		return nil, fmt.Errorf("ndjson-batch: unknown format %q", format)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// compressionPool reuses gzip/zstd/lz4/snappy decoder instances across
+// requests so decompressing an ingest body doesn't allocate a new decoder
+// on every call, mirroring bufferPool for the raw byte buffers it hands
+// parserFunc.
+var compressionPool = struct {
+	gzip   sync.Pool
+	zstd   sync.Pool
+	lz4    sync.Pool
+	snappy sync.Pool
+}{
+	gzip: sync.Pool{New: func() interface{} { return new(gzip.Reader) }},
+	zstd: sync.Pool{New: func() interface{} {
+		d, _ := zstd.NewReader(nil)
+		return d
+	}},
+	lz4:    sync.Pool{New: func() interface{} { return lz4.NewReader(nil) }},
+	snappy: sync.Pool{New: func() interface{} { return snappy.NewReader(nil) }},
+}
+
+// decompressBody wraps r.Body with a decompressing reader according to
+// the request's Content-Encoding header (gzip, zstd, lz4, snappy). An
+// empty or "identity" encoding is a no-op. The returned io.ReadCloser
+// must be closed by the caller, which also returns any pooled decoder.
+func decompressBody(r *http.Request) (io.ReadCloser, error) {
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		return r.Body, nil
+
+	case "gzip":
+		zr := compressionPool.gzip.Get().(*gzip.Reader)
+		if err := zr.Reset(r.Body); err != nil {
+			compressionPool.gzip.Put(zr)
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		return &pooledReader{Reader: zr, body: r.Body, release: func() { compressionPool.gzip.Put(zr) }}, nil
+
+	case "zstd":
+		zd := compressionPool.zstd.Get().(*zstd.Decoder)
+		if err := zd.Reset(r.Body); err != nil {
+			compressionPool.zstd.Put(zd)
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		return &pooledReader{Reader: zd, body: r.Body, release: func() { compressionPool.zstd.Put(zd) }}, nil
+
+	case "lz4":
+		lr := compressionPool.lz4.Get().(*lz4.Reader)
+		lr.Reset(r.Body)
+		return &pooledReader{Reader: lr, body: r.Body, release: func() { compressionPool.lz4.Put(lr) }}, nil
+
+	case "snappy":
+		sr := compressionPool.snappy.Get().(*snappy.Reader)
+		sr.Reset(r.Body)
+		return &pooledReader{Reader: sr, body: r.Body, release: func() { compressionPool.snappy.Put(sr) }}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", r.Header.Get("Content-Encoding"))
+	}
+}
+
+// pooledReader closes both the decompressor (returning it to its pool, if
+// pooled) and the underlying request body.
+type pooledReader struct {
+	io.Reader
+	body    io.Closer
+	release func()
+}
+
+func (p *pooledReader) Close() error {
+	if p.release != nil {
+		p.release()
+	}
+	return p.body.Close()
+}
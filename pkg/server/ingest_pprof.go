@@ -0,0 +1,133 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+// formatPprof is the format/Content-Type identifier for the standard Go
+// runtime/pprof protobuf profile (the format net/http/pprof serves).
+const formatPprof = "pprof"
+
+// pprofSampleTypeConfig maps a pprof sample type name onto pyroscope's
+// units/aggregationType model.
+type pprofSampleTypeConfig struct {
+	units           string
+	aggregationType string
+}
+
+var pprofSampleTypeConfigs = map[string]pprofSampleTypeConfig{
+	"cpu":           {units: "samples", aggregationType: "sum"},
+	"samples":       {units: "samples", aggregationType: "sum"},
+	"alloc_objects": {units: "objects", aggregationType: "sum"},
+	"alloc_space":   {units: "bytes", aggregationType: "sum"},
+	"inuse_objects": {units: "objects", aggregationType: "average"},
+	"inuse_space":   {units: "bytes", aggregationType: "average"},
+}
+
+// ingestPprof decodes a gzipped pprof profile (as produced by
+// runtime/pprof and net/http/pprof) and ingests one tree per sample type
+// present in the profile, so a single `go tool pprof`-compatible payload
+// can populate cpu, alloc_objects, alloc_space, etc. independently.
+func (ctrl *Controller) ingestPprof(w http.ResponseWriter, r *http.Request, ip *ingestParams) {
+	// r.Body's lifecycle (including returning any pooled decoder from
+	// decompressBody) is owned by ingestHandler's defer; don't close it here.
+	gzr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		ctrl.writeInvalidParameterError(w, fmt.Errorf("pprof: %w", err))
+		return
+	}
+	defer gzr.Close()
+
+	p, err := profile.Parse(gzr)
+	if err != nil {
+		ctrl.writeError(w, http.StatusUnprocessableEntity, err, "error happened while parsing pprof profile")
+		return
+	}
+
+	for i, st := range p.SampleType {
+		t := pprofSampleTypeTree(p, i)
+		if t == nil {
+			continue
+		}
+
+		cfg, ok := pprofSampleTypeConfigs[st.Type]
+		if !ok {
+			cfg = pprofSampleTypeConfig{units: "samples", aggregationType: "sum"}
+		}
+
+		err = ctrl.ingester.Put(&storage.PutInput{
+			StartTime:       ip.from,
+			EndTime:         ip.until,
+			Key:             pprofKeyForSampleType(ip.storageKey, st.Type),
+			Val:             t,
+			SpyName:         ip.spyName,
+			SampleRate:      ip.sampleRate,
+			Units:           cfg.units,
+			AggregationType: cfg.aggregationType,
+		})
+		if err != nil {
+			ctrl.writeInternalServerError(w, err, "error happened while ingesting data")
+			return
+		}
+
+		ctrl.statsInc("ingest")
+		ctrl.statsInc("ingest:" + ip.spyName)
+	}
+
+	k := *ip.storageKey
+	ctrl.appStats.Add(hashString(k.AppName()))
+}
+
+// pprofSampleTypeTree builds a tree.Tree out of the values at index i of
+// every sample in p, skipping samples with a zero or negative value.
+func pprofSampleTypeTree(p *profile.Profile, i int) *tree.Tree {
+	t := tree.New()
+	inserted := false
+	for _, s := range p.Sample {
+		if i >= len(s.Value) || s.Value[i] <= 0 {
+			continue
+		}
+		t.Insert(pprofStack(s), uint64(s.Value[i]))
+		inserted = true
+	}
+	if !inserted {
+		return nil
+	}
+	return t
+}
+
+// pprofStack builds a `root;...;leaf` folded stack string out of a pprof
+// sample's locations, which are recorded leaf-first.
+func pprofStack(s *profile.Sample) []byte {
+	frames := make([]string, 0, len(s.Location))
+	for i := len(s.Location) - 1; i >= 0; i-- {
+		loc := s.Location[i]
+		for j := len(loc.Line) - 1; j >= 0; j-- {
+			if fn := loc.Line[j].Function; fn != nil && fn.Name != "" {
+				frames = append(frames, fn.Name)
+			}
+		}
+	}
+	return []byte(strings.Join(frames, ";"))
+}
+
+// pprofKeyForSampleType clones base, renaming the app to
+// "<app>.<sampleType>" so that e.g. cpu and inuse_space samples from the
+// same profile land in separate series instead of overwriting each other.
+func pprofKeyForSampleType(base *segment.Key, sampleType string) *segment.Key {
+	labels := make(map[string]string, len(base.Labels()))
+	for k, v := range base.Labels() {
+		labels[k] = v
+	}
+	labels["__name__"] = base.AppName() + "." + sampleType
+	return segment.NewKey(labels)
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RelabelAction mirrors Prometheus's relabel_config actions, applied to a
+// sample's label set at ingest time.
+type RelabelAction string
+
+const (
+	RelabelReplace   RelabelAction = "replace"
+	RelabelKeep      RelabelAction = "keep"
+	RelabelDrop      RelabelAction = "drop"
+	RelabelLabelDrop RelabelAction = "labeldrop"
+	RelabelLabelKeep RelabelAction = "labelkeep"
+	RelabelHashMod   RelabelAction = "hashmod"
+)
+
+// RelabelRule rewrites or filters an ingest request's label set.
+// SourceLabels are joined with Separator (";" by default) and matched
+// against Regex, as in Prometheus relabel_config.
+type RelabelRule struct {
+	SourceLabels []string      `json:"source_labels" yaml:"source_labels"`
+	Separator    string        `json:"separator" yaml:"separator"`
+	Regex        string        `json:"regex" yaml:"regex"`
+	Action       RelabelAction `json:"action" yaml:"action"`
+	TargetLabel  string        `json:"target_label" yaml:"target_label"`
+	Replacement  string        `json:"replacement" yaml:"replacement"`
+	Modulus      uint64        `json:"modulus" yaml:"modulus"`
+
+	regex *regexp.Regexp
+}
+
+func (rule *RelabelRule) compiled() (*regexp.Regexp, error) {
+	if rule.regex != nil {
+		return rule.regex, nil
+	}
+	pattern := rule.Regex
+	if pattern == "" {
+		pattern = "(.*)"
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+	rule.regex = re
+	return re, nil
+}
+
+// Relabeler applies an ordered set of RelabelRules to ingest label sets.
+type Relabeler struct {
+	mu    sync.RWMutex
+	rules []RelabelRule
+}
+
+// NewRelabeler builds a Relabeler from a list of rules, evaluated in order.
+func NewRelabeler(rules []RelabelRule) *Relabeler {
+	return &Relabeler{rules: rules}
+}
+
+// SetRules replaces the relabeler's rule set.
+func (rl *Relabeler) SetRules(rules []RelabelRule) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.rules = rules
+}
+
+// Apply runs every rule against labels in order, mutating it in place. It
+// returns keep=false once a rule drops the sample entirely, at which
+// point no further rules are evaluated.
+func (rl *Relabeler) Apply(labels map[string]string) (keep bool, err error) {
+	rl.mu.RLock()
+	rules := rl.rules
+	rl.mu.RUnlock()
+
+	for i := range rules {
+		keep, err = applyRelabelRule(&rules[i], labels)
+		if err != nil || !keep {
+			return keep, err
+		}
+	}
+	return true, nil
+}
+
+func applyRelabelRule(rule *RelabelRule, labels map[string]string) (bool, error) {
+	re, err := rule.compiled()
+	if err != nil {
+		return false, err
+	}
+
+	sep := rule.Separator
+	if sep == "" {
+		sep = ";"
+	}
+	values := make([]string, len(rule.SourceLabels))
+	for i, l := range rule.SourceLabels {
+		values[i] = labels[l]
+	}
+	joined := strings.Join(values, sep)
+
+	switch rule.Action {
+	case RelabelKeep:
+		return re.MatchString(joined), nil
+
+	case RelabelDrop:
+		return !re.MatchString(joined), nil
+
+	case RelabelLabelDrop:
+		for k := range labels {
+			if re.MatchString(k) {
+				delete(labels, k)
+			}
+		}
+		return true, nil
+
+	case RelabelLabelKeep:
+		for k := range labels {
+			if !re.MatchString(k) {
+				delete(labels, k)
+			}
+		}
+		return true, nil
+
+	case RelabelHashMod:
+		if rule.Modulus == 0 || rule.TargetLabel == "" {
+			return true, nil
+		}
+		sum := md5.Sum([]byte(joined))
+		hash := binary.BigEndian.Uint64(sum[8:])
+		labels[rule.TargetLabel] = strconv.FormatUint(hash%rule.Modulus, 10)
+		return true, nil
+
+	case RelabelReplace, "":
+		if !re.MatchString(joined) || rule.TargetLabel == "" {
+			return true, nil
+		}
+		labels[rule.TargetLabel] = re.ReplaceAllString(joined, rule.Replacement)
+		return true, nil
+
+	default:
+		return false, fmt.Errorf("relabel: unknown action %q", rule.Action)
+	}
+}
+
+// SetRelabeler installs the Relabeler applied to every ingest request's
+// label set before it reaches the ingester. Passing nil disables
+// relabeling. It lives on Controller (fields relabelerMu/relabeler)
+// rather than as a package var, so each Controller can run under its own
+// relabeling configuration instead of sharing one global.
+func (ctrl *Controller) SetRelabeler(rl *Relabeler) {
+	ctrl.relabelerMu.Lock()
+	defer ctrl.relabelerMu.Unlock()
+	ctrl.relabeler = rl
+}
+
+func (ctrl *Controller) currentRelabeler() *Relabeler {
+	ctrl.relabelerMu.RLock()
+	defer ctrl.relabelerMu.RUnlock()
+	return ctrl.relabeler
+}
@@ -0,0 +1,141 @@
+package server
+
+import "testing"
+
+func TestApplyRelabelRuleReplace(t *testing.T) {
+	rule := &RelabelRule{
+		SourceLabels: []string{"namespace", "pod"},
+		Separator:    "/",
+		Regex:        "(.+)/(.+)",
+		Action:       RelabelReplace,
+		TargetLabel:  "workload",
+		Replacement:  "$1-$2",
+	}
+	labels := map[string]string{"namespace": "prod", "pod": "api-1"}
+	keep, err := applyRelabelRule(rule, labels)
+	if err != nil {
+		t.Fatalf("applyRelabelRule: %v", err)
+	}
+	if !keep {
+		t.Fatal("expected keep=true")
+	}
+	if labels["workload"] != "prod-api-1" {
+		t.Errorf("workload = %q, want %q", labels["workload"], "prod-api-1")
+	}
+}
+
+func TestApplyRelabelRuleDefaultActionIsReplace(t *testing.T) {
+	rule := &RelabelRule{
+		SourceLabels: []string{"env"},
+		Regex:        "(.*)",
+		TargetLabel:  "environment",
+		Replacement:  "$1",
+	}
+	labels := map[string]string{"env": "staging"}
+	if _, err := applyRelabelRule(rule, labels); err != nil {
+		t.Fatalf("applyRelabelRule: %v", err)
+	}
+	if labels["environment"] != "staging" {
+		t.Errorf("environment = %q, want %q", labels["environment"], "staging")
+	}
+}
+
+func TestApplyRelabelRuleKeep(t *testing.T) {
+	rule := &RelabelRule{
+		SourceLabels: []string{"env"},
+		Regex:        "prod",
+		Action:       RelabelKeep,
+	}
+	if keep, err := applyRelabelRule(rule, map[string]string{"env": "prod"}); err != nil || !keep {
+		t.Errorf("env=prod: keep=%v, err=%v, want keep=true", keep, err)
+	}
+	if keep, err := applyRelabelRule(rule, map[string]string{"env": "staging"}); err != nil || keep {
+		t.Errorf("env=staging: keep=%v, err=%v, want keep=false", keep, err)
+	}
+}
+
+func TestApplyRelabelRuleDrop(t *testing.T) {
+	rule := &RelabelRule{
+		SourceLabels: []string{"env"},
+		Regex:        "staging",
+		Action:       RelabelDrop,
+	}
+	if keep, err := applyRelabelRule(rule, map[string]string{"env": "staging"}); err != nil || keep {
+		t.Errorf("env=staging: keep=%v, err=%v, want keep=false", keep, err)
+	}
+	if keep, err := applyRelabelRule(rule, map[string]string{"env": "prod"}); err != nil || !keep {
+		t.Errorf("env=prod: keep=%v, err=%v, want keep=true", keep, err)
+	}
+}
+
+func TestApplyRelabelRuleLabelDrop(t *testing.T) {
+	rule := &RelabelRule{Regex: "^tmp_.*", Action: RelabelLabelDrop}
+	labels := map[string]string{"tmp_foo": "a", "tmp_bar": "b", "keep": "c"}
+	if _, err := applyRelabelRule(rule, labels); err != nil {
+		t.Fatalf("applyRelabelRule: %v", err)
+	}
+	if len(labels) != 1 || labels["keep"] != "c" {
+		t.Errorf("labels = %v, want only {keep: c}", labels)
+	}
+}
+
+func TestApplyRelabelRuleLabelKeep(t *testing.T) {
+	rule := &RelabelRule{Regex: "^tmp_.*", Action: RelabelLabelKeep}
+	labels := map[string]string{"tmp_foo": "a", "tmp_bar": "b", "keep": "c"}
+	if _, err := applyRelabelRule(rule, labels); err != nil {
+		t.Fatalf("applyRelabelRule: %v", err)
+	}
+	if len(labels) != 2 || labels["tmp_foo"] != "a" || labels["tmp_bar"] != "b" {
+		t.Errorf("labels = %v, want only tmp_foo/tmp_bar", labels)
+	}
+}
+
+func TestApplyRelabelRuleHashMod(t *testing.T) {
+	rule := &RelabelRule{
+		SourceLabels: []string{"pod"},
+		Action:       RelabelHashMod,
+		TargetLabel:  "shard",
+		Modulus:      16,
+	}
+	labels := map[string]string{"pod": "api-1"}
+	if _, err := applyRelabelRule(rule, labels); err != nil {
+		t.Fatalf("applyRelabelRule: %v", err)
+	}
+	shard, ok := labels["shard"]
+	if !ok {
+		t.Fatal("expected shard label to be set")
+	}
+	// Re-running against the same input must be stable.
+	labels2 := map[string]string{"pod": "api-1"}
+	if _, err := applyRelabelRule(rule, labels2); err != nil {
+		t.Fatalf("applyRelabelRule: %v", err)
+	}
+	if labels2["shard"] != shard {
+		t.Errorf("hashmod not stable: got %q then %q", shard, labels2["shard"])
+	}
+}
+
+func TestApplyRelabelRuleUnknownAction(t *testing.T) {
+	rule := &RelabelRule{Action: "dorp"}
+	if _, err := applyRelabelRule(rule, map[string]string{}); err == nil {
+		t.Fatal("expected an error for an unknown action, got nil")
+	}
+}
+
+func TestRelabelerApplyStopsAtFirstDrop(t *testing.T) {
+	rl := NewRelabeler([]RelabelRule{
+		{SourceLabels: []string{"env"}, Regex: "staging", Action: RelabelDrop},
+		{SourceLabels: []string{"env"}, Regex: "(.*)", Action: RelabelReplace, TargetLabel: "untouched", Replacement: "$1"},
+	})
+	labels := map[string]string{"env": "staging"}
+	keep, err := rl.Apply(labels)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if keep {
+		t.Fatal("expected keep=false")
+	}
+	if _, ok := labels["untouched"]; ok {
+		t.Error("rules after a drop must not run")
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator validates the tenant identity carried by an ingest
+// request — either a Cortex-style X-Scope-OrgID header or a signed bearer
+// token — and returns the tenant ID to isolate the request's data under.
+type Authenticator interface {
+	Authenticate(r *http.Request) (tenantID string, err error)
+}
+
+// HeaderAuthenticator is the simplest Authenticator: it trusts the
+// X-Scope-OrgID header, or failing that a bearer token, verbatim. It
+// performs no cryptographic validation, so it's meant for deployments
+// that authenticate tenants at a reverse proxy in front of pyroscope.
+type HeaderAuthenticator struct{}
+
+func (HeaderAuthenticator) Authenticate(r *http.Request) (string, error) {
+	if id := r.Header.Get("X-Scope-OrgID"); id != "" {
+		return id, nil
+	}
+	if token := bearerToken(r); token != "" {
+		return token, nil
+	}
+	return "", fmt.Errorf("tenant: no X-Scope-OrgID header or bearer token present")
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(h, prefix)
+}
+
+// TenantConfig holds per-tenant ingest limits, enforced before data
+// reaches the ingester.
+type TenantConfig struct {
+	RateLimit            int // requests per second; 0 disables the limit
+	MaxSeriesCardinality int // distinct series; 0 disables the cap
+}
+
+// tenantRegistry holds a Controller's tenant auth configuration and
+// per-tenant rate-limit/cardinality state. It lives on Controller (field
+// tenants) rather than as a package var, so that two Controllers in the
+// same process - e.g. in tests - can run under independent tenant
+// configuration instead of sharing one global.
+type tenantRegistry struct {
+	mu            sync.RWMutex
+	authenticator Authenticator
+	configs       map[string]TenantConfig
+	state         map[string]*tenantState
+}
+
+type tenantState struct {
+	mu          sync.Mutex
+	series      map[string]struct{}
+	windowStart time.Time
+	windowCount int
+}
+
+// SetAuthenticator installs the Authenticator used to validate tenant
+// identity on ingest requests. Passing nil disables multi-tenant auth, so
+// every request is treated as belonging to the default, unlabeled tenant.
+func (ctrl *Controller) SetAuthenticator(a Authenticator) {
+	ctrl.tenants.mu.Lock()
+	defer ctrl.tenants.mu.Unlock()
+	ctrl.tenants.authenticator = a
+}
+
+// SetTenantConfig installs the ingest limits for tenantID, replacing any
+// previous configuration.
+func (ctrl *Controller) SetTenantConfig(tenantID string, cfg TenantConfig) {
+	ctrl.tenants.mu.Lock()
+	defer ctrl.tenants.mu.Unlock()
+	if ctrl.tenants.configs == nil {
+		ctrl.tenants.configs = map[string]TenantConfig{}
+	}
+	ctrl.tenants.configs[tenantID] = cfg
+}
+
+var errTenantLimitExceeded = fmt.Errorf("tenant: rate limit or series cardinality limit exceeded")
+
+// authenticateTenant returns the tenant ID for r, or "" when no
+// Authenticator is configured. It errors when auth is enabled and no
+// valid tenant could be determined.
+func (ctrl *Controller) authenticateTenant(r *http.Request) (string, error) {
+	ctrl.tenants.mu.RLock()
+	a := ctrl.tenants.authenticator
+	ctrl.tenants.mu.RUnlock()
+	if a == nil {
+		return "", nil
+	}
+
+	id, err := a.Authenticate(r)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", fmt.Errorf("tenant: no tenant ID found in request")
+	}
+	return id, nil
+}
+
+// enforceTenantLimits applies tenantID's configured rate limit and series
+// cardinality cap to seriesKey, returning errTenantLimitExceeded once
+// either is exhausted.
+func (ctrl *Controller) enforceTenantLimits(tenantID, seriesKey string) error {
+	ctrl.tenants.mu.RLock()
+	cfg := ctrl.tenants.configs[tenantID]
+	ctrl.tenants.mu.RUnlock()
+	if cfg.RateLimit == 0 && cfg.MaxSeriesCardinality == 0 {
+		return nil
+	}
+
+	ctrl.tenants.mu.Lock()
+	st, ok := ctrl.tenants.state[tenantID]
+	if !ok {
+		if ctrl.tenants.state == nil {
+			ctrl.tenants.state = map[string]*tenantState{}
+		}
+		st = &tenantState{series: map[string]struct{}{}}
+		ctrl.tenants.state[tenantID] = st
+	}
+	ctrl.tenants.mu.Unlock()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if cfg.RateLimit > 0 {
+		now := time.Now()
+		if now.Sub(st.windowStart) >= time.Second {
+			st.windowStart = now
+			st.windowCount = 0
+		}
+		if st.windowCount >= cfg.RateLimit {
+			return errTenantLimitExceeded
+		}
+		st.windowCount++
+	}
+
+	if cfg.MaxSeriesCardinality > 0 {
+		if _, ok := st.series[seriesKey]; !ok && len(st.series) >= cfg.MaxSeriesCardinality {
+			return errTenantLimitExceeded
+		}
+		st.series[seriesKey] = struct{}{}
+	}
+
+	return nil
+}